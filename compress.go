@@ -0,0 +1,102 @@
+package uhc
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// WithDisableCompression disables the transparent Accept-Encoding
+// advertisement and response decompression described on
+// Transport.DisableCompression.
+func WithDisableCompression(disable bool) TransportOption {
+	return func(t *Transport) {
+		t.DisableCompression = disable
+	}
+}
+
+// maybeSetAcceptEncoding advertises gzip/br support and takes on the job of
+// decoding the response, the same way http.Transport does when the caller
+// hasn't set Accept-Encoding itself. It reports whether it did so, since a
+// caller-supplied Accept-Encoding (or DisableCompression) means the response
+// body is handed back untouched.
+func (t *Transport) maybeSetAcceptEncoding(req *http.Request) bool {
+	if t.DisableCompression || req.Header.Get("Accept-Encoding") != "" {
+		return false
+	}
+	// A Range request wants a slice of the on-the-wire representation, and a
+	// HEAD response has no body to decode either way; forcing compression
+	// here is how net/http.Transport ended up serving garbled partial
+	// content (golang.org/issue/8923), so skip it the same way it now does.
+	if req.Header.Get("Range") != "" || req.Method == http.MethodHead {
+		return false
+	}
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	return true
+}
+
+// decodeResponse transparently decompresses resp.Body per its
+// Content-Encoding and fixes up Content-Length/Content-Encoding to match,
+// when we were the one who asked for compression.
+func (t *Transport) decodeResponse(resp *http.Response, setAcceptEncoding bool) *http.Response {
+	if !setAcceptEncoding {
+		return resp
+	}
+
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		resp.Body = &gzipBody{rawBody: resp.Body}
+	case "br":
+		resp.Body = &brotliBody{rawBody: resp.Body, reader: brotli.NewReader(resp.Body)}
+	default:
+		return resp
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp
+}
+
+// gzipBody lazily initializes the gzip reader on first Read, so a failure to
+// parse the gzip header surfaces as a read error rather than at wrap time.
+// Close always closes rawBody (the pooled utlsHttpBody, when present) so the
+// underlying uTLS connection is still released or discarded as usual.
+type gzipBody struct {
+	rawBody io.ReadCloser
+	zr      *gzip.Reader
+	zrErr   error
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	if g.zr == nil && g.zrErr == nil {
+		g.zr, g.zrErr = gzip.NewReader(g.rawBody)
+	}
+	if g.zrErr != nil {
+		return 0, g.zrErr
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gzipBody) Close() error {
+	return g.rawBody.Close()
+}
+
+// brotliBody decodes a br-encoded body, closing through to rawBody the same
+// way gzipBody does.
+type brotliBody struct {
+	rawBody io.ReadCloser
+	reader  *brotli.Reader
+}
+
+func (b *brotliBody) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func (b *brotliBody) Close() error {
+	return b.rawBody.Close()
+}
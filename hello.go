@@ -0,0 +1,65 @@
+package uhc
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// ClientHelloIDFunc picks the ClientHelloID to present for a given request,
+// for callers that want to vary the TLS fingerprint instead of using one
+// static ClientHelloID for every connection.
+type ClientHelloIDFunc func(*http.Request) utls.ClientHelloID
+
+// ClientHelloIDRotator cycles through a fixed set of ClientHelloIDs, either
+// once per request or once per host (with the same host always reusing the
+// ID it was first assigned).
+type ClientHelloIDRotator struct {
+	ids  []utls.ClientHelloID
+	next uint32
+
+	mu      sync.Mutex
+	perHost map[string]utls.ClientHelloID
+}
+
+// NewClientHelloIDRotator builds a rotator over ids. It panics if ids is
+// empty, since there would be nothing to rotate through.
+func NewClientHelloIDRotator(ids ...utls.ClientHelloID) *ClientHelloIDRotator {
+	if len(ids) == 0 {
+		panic("uhc: NewClientHelloIDRotator requires at least one ClientHelloID")
+	}
+	return &ClientHelloIDRotator{
+		ids:     ids,
+		perHost: make(map[string]utls.ClientHelloID),
+	}
+}
+
+// PerRequest returns a ClientHelloIDFunc that round-robins through the
+// rotator's IDs on every call, regardless of host.
+func (r *ClientHelloIDRotator) PerRequest() ClientHelloIDFunc {
+	return func(*http.Request) utls.ClientHelloID {
+		n := atomic.AddUint32(&r.next, 1) - 1
+		return r.ids[n%uint32(len(r.ids))]
+	}
+}
+
+// PerHost returns a ClientHelloIDFunc that assigns each host the next ID in
+// round-robin order the first time it's seen, then keeps presenting that
+// same ID to that host on every later request.
+func (r *ClientHelloIDRotator) PerHost() ClientHelloIDFunc {
+	return func(req *http.Request) utls.ClientHelloID {
+		host := req.URL.Hostname()
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if id, ok := r.perHost[host]; ok {
+			return id
+		}
+		id := r.ids[int(r.next)%len(r.ids)]
+		r.next++
+		r.perHost[host] = id
+		return id
+	}
+}
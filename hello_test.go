@@ -0,0 +1,134 @@
+package uhc
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestClientHelloIDRotatorPerRequestRoundRobin(t *testing.T) {
+	ids := []utls.ClientHelloID{utls.HelloChrome_Auto, utls.HelloFirefox_Auto, utls.HelloIOS_Auto}
+	fn := NewClientHelloIDRotator(ids...).PerRequest()
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	for i := 0; i < len(ids)*2+1; i++ {
+		if got, want := fn(req), ids[i%len(ids)]; got != want {
+			t.Fatalf("call %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+}
+
+func TestClientHelloIDRotatorPerHostSticky(t *testing.T) {
+	ids := []utls.ClientHelloID{utls.HelloChrome_Auto, utls.HelloFirefox_Auto}
+	fn := NewClientHelloIDRotator(ids...).PerHost()
+
+	reqA, _ := http.NewRequest(http.MethodGet, "https://a.example", nil)
+	reqB, _ := http.NewRequest(http.MethodGet, "https://b.example", nil)
+
+	firstA := fn(reqA)
+	firstB := fn(reqB)
+	if firstA == firstB {
+		t.Fatalf("expected distinct hosts to get distinct IDs on first sight, both got %+v", firstA)
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := fn(reqA); got != firstA {
+			t.Fatalf("expected a.example to keep its assigned ID, got %+v want %+v", got, firstA)
+		}
+		if got := fn(reqB); got != firstB {
+			t.Fatalf("expected b.example to keep its assigned ID, got %+v want %+v", got, firstB)
+		}
+	}
+}
+
+func TestClientHelloIDRotatorPanicsOnEmpty(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected NewClientHelloIDRotator to panic with no IDs")
+		}
+	}()
+	NewClientHelloIDRotator()
+}
+
+func TestSelectClientHelloDefault(t *testing.T) {
+	tr := &Transport{}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	id, spec, key := tr.selectClientHello(req)
+	if id != defaultClientHelloID {
+		t.Fatalf("expected the default ClientHelloID, got %+v", id)
+	}
+	if spec != nil {
+		t.Fatal("expected no custom spec")
+	}
+	if key != defaultClientHelloID.Str() {
+		t.Fatalf("unexpected pool key %q", key)
+	}
+}
+
+func TestSelectClientHelloStatic(t *testing.T) {
+	tr := &Transport{ClientHelloID: utls.HelloFirefox_Auto}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	id, spec, key := tr.selectClientHello(req)
+	if id != utls.HelloFirefox_Auto {
+		t.Fatalf("expected the configured ClientHelloID, got %+v", id)
+	}
+	if spec != nil {
+		t.Fatal("expected no custom spec")
+	}
+	if key != utls.HelloFirefox_Auto.Str() {
+		t.Fatalf("unexpected pool key %q", key)
+	}
+}
+
+func TestSelectClientHelloFunc(t *testing.T) {
+	called := false
+	tr := &Transport{
+		ClientHelloID: utls.HelloFirefox_Auto, // should be overridden by the func
+		ClientHelloIDFunc: func(*http.Request) utls.ClientHelloID {
+			called = true
+			return utls.HelloIOS_Auto
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	id, spec, key := tr.selectClientHello(req)
+	if !called {
+		t.Fatal("expected ClientHelloIDFunc to be called")
+	}
+	if id != utls.HelloIOS_Auto {
+		t.Fatalf("expected the func's ClientHelloID, got %+v", id)
+	}
+	if spec != nil {
+		t.Fatal("expected no custom spec")
+	}
+	if key != utls.HelloIOS_Auto.Str() {
+		t.Fatalf("unexpected pool key %q", key)
+	}
+}
+
+func TestSelectClientHelloSpecTakesPrecedence(t *testing.T) {
+	spec := &utls.ClientHelloSpec{}
+	tr := &Transport{
+		ClientHelloSpec: spec,
+		ClientHelloIDFunc: func(*http.Request) utls.ClientHelloID {
+			t.Fatal("ClientHelloIDFunc should not be consulted when ClientHelloSpec is set")
+			return utls.ClientHelloID{}
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	id, gotSpec, key := tr.selectClientHello(req)
+	if id != utls.HelloCustom {
+		t.Fatalf("expected HelloCustom, got %+v", id)
+	}
+	if gotSpec != spec {
+		t.Fatal("expected the configured ClientHelloSpec to be returned")
+	}
+	if want := fmt.Sprintf("spec-%p", spec); key != want {
+		t.Fatalf("expected pool key %q, got %q", want, key)
+	}
+}
@@ -0,0 +1,200 @@
+package uhc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	utls "github.com/refraction-networking/utls"
+)
+
+// quicBackoff is how long we wait before retrying HTTP/3 against an
+// authority after a QUIC handshake failure, so a single blocked UDP path
+// doesn't pay a handshake timeout on every request.
+const quicBackoff = 30 * time.Second
+
+// WithForceHTTP3 always tries HTTP/3 first, instead of only doing so once
+// the target has advertised h3 support via Alt-Svc.
+func WithForceHTTP3(force bool) TransportOption {
+	return func(t *Transport) {
+		t.ForceHTTP3 = force
+	}
+}
+
+// altSvcCache remembers, per authority, whether the server has advertised
+// HTTP/3 support via Alt-Svc, and for how long that's valid. It also tracks
+// a short backoff window after a failed QUIC handshake.
+type altSvcCache struct {
+	mu      sync.Mutex
+	h3      map[string]time.Time // authority -> expiry
+	backoff map[string]time.Time // authority -> retry-after
+}
+
+func newAltSvcCache() *altSvcCache {
+	return &altSvcCache{
+		h3:      make(map[string]time.Time),
+		backoff: make(map[string]time.Time),
+	}
+}
+
+func (c *altSvcCache) supportsH3(authority string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiry, ok := c.h3[authority]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(c.h3, authority)
+		return false
+	}
+	return true
+}
+
+func (c *altSvcCache) rememberH3(authority string, maxAge time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.h3[authority] = time.Now().Add(maxAge)
+}
+
+func (c *altSvcCache) isBackingOff(authority string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.backoff[authority]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(c.backoff, authority)
+		return false
+	}
+	return true
+}
+
+func (c *altSvcCache) recordFailure(authority string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backoff[authority] = time.Now().Add(quicBackoff)
+}
+
+// observe updates the cache from a response's Alt-Svc header, if any.
+func (c *altSvcCache) observe(authority, header string) {
+	if header == "" {
+		return
+	}
+	if maxAge, ok := parseAltSvc(header); ok {
+		c.rememberH3(authority, maxAge)
+	}
+}
+
+// parseAltSvc looks for an "h3" entry in an Alt-Svc header value and returns
+// how long it should be cached for, per the "ma" (max-age) parameter. See
+// RFC 7838. The alternative authority (host:port) inside the entry is not
+// examined: an h3 entry naming another host or port still counts as h3
+// support, and HTTP/3 is then dialed at the authority we were asked for.
+func parseAltSvc(header string) (time.Duration, bool) {
+	maxAge := 24 * time.Hour
+	found := false
+
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(entry, ";")
+		protoAndAuthority := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(protoAndAuthority, `h3=`) {
+			continue
+		}
+		found = true
+
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if ma, ok := strings.CutPrefix(param, "ma="); ok {
+				if secs, err := strconv.Atoi(strings.TrimSpace(ma)); err == nil {
+					maxAge = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		break
+	}
+
+	return maxAge, found
+}
+
+// roundTripH3 tries to do req over HTTP/3, dialing a fresh QUIC connection
+// (or reusing one from pool) as needed. The caller falls back to h2/h1 on
+// error.
+func (t *Transport) roundTripH3(ctx context.Context, req *http.Request, pool *connPool, key string, clientHelloID utls.ClientHelloID, authority string) (*http.Response, error) {
+	if rt := pool.getH3(key); rt != nil {
+		return rt.RoundTrip(req)
+	}
+
+	serverName := req.URL.Hostname()
+	if t.ServerName != "" {
+		serverName = t.ServerName
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{http3.NextProtoH3},
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		// crypto/tls doesn't expose TLS 1.3 cipher/curve ordering the way
+		// uTLS does for TCP, so this is a best-effort approximation of the
+		// selected ClientHelloID rather than a byte-for-byte parrot.
+		CipherSuites:     cipherSuitesFor(clientHelloID),
+		CurvePreferences: curvesFor(clientHelloID),
+	}
+
+	conn, err := quic.DialAddr(ctx, authority, tlsConfig, nil)
+	if err != nil {
+		return nil, fmt.Errorf("quic dial %s failed: %w", authority, err)
+	}
+
+	rt := &http3.SingleDestinationRoundTripper{
+		Connection: conn,
+	}
+	rt.Start()
+	pool.putH3(key, rt, conn)
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("do http/3 request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// cipherSuitesFor approximates the TLS 1.2 cipher order a given
+// ClientHelloID would present; it has no effect on TLS 1.3, which the QUIC
+// handshake always uses.
+func cipherSuitesFor(id utls.ClientHelloID) []uint16 {
+	switch id.Client {
+	case "Firefox":
+		return []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		}
+	default:
+		return []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		}
+	}
+}
+
+func curvesFor(id utls.ClientHelloID) []tls.CurveID {
+	switch id.Client {
+	case "Firefox":
+		return []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+	default:
+		return []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+	}
+}
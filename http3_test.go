@@ -0,0 +1,101 @@
+package uhc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAltSvcMaxAge(t *testing.T) {
+	maxAge, found := parseAltSvc(`h3=":443"; ma=3600`)
+	if !found {
+		t.Fatal("expected an h3 entry to be found")
+	}
+	if maxAge != 3600*time.Second {
+		t.Fatalf("expected a max-age of 3600s, got %v", maxAge)
+	}
+}
+
+func TestParseAltSvcDefaultMaxAge(t *testing.T) {
+	maxAge, found := parseAltSvc(`h3=":443"`)
+	if !found {
+		t.Fatal("expected an h3 entry to be found")
+	}
+	if maxAge != 24*time.Hour {
+		t.Fatalf("expected the default 24h max-age when ma= is absent, got %v", maxAge)
+	}
+}
+
+func TestParseAltSvcIgnoresOtherVersions(t *testing.T) {
+	_, found := parseAltSvc(`h3-29=":443"; ma=3600`)
+	if found {
+		t.Fatal("expected an h3-29 entry not to be treated as h3 support")
+	}
+}
+
+func TestParseAltSvcMultipleEntriesUsesFirstH3(t *testing.T) {
+	maxAge, found := parseAltSvc(`h3-29=":443"; ma=1, h3=":443"; ma=7200`)
+	if !found {
+		t.Fatal("expected the h3 entry among several to be found")
+	}
+	if maxAge != 7200*time.Second {
+		t.Fatalf("expected the h3 entry's max-age of 7200s, got %v", maxAge)
+	}
+}
+
+func TestParseAltSvcNoH3(t *testing.T) {
+	_, found := parseAltSvc("clear")
+	if found {
+		t.Fatal("expected no h3 support to be found in a header with no h3 entry")
+	}
+}
+
+func TestAltSvcCacheSupportsH3Expiry(t *testing.T) {
+	c := newAltSvcCache()
+	if c.supportsH3("example.com:443") {
+		t.Fatal("expected no h3 support before anything is remembered")
+	}
+
+	c.rememberH3("example.com:443", time.Hour)
+	if !c.supportsH3("example.com:443") {
+		t.Fatal("expected h3 support to be remembered within its max-age")
+	}
+
+	c.rememberH3("expired.example:443", -time.Second)
+	if c.supportsH3("expired.example:443") {
+		t.Fatal("expected an already-expired entry not to report h3 support")
+	}
+}
+
+func TestAltSvcCacheBackoff(t *testing.T) {
+	c := newAltSvcCache()
+	if c.isBackingOff("example.com:443") {
+		t.Fatal("expected no backoff before any failure is recorded")
+	}
+
+	c.recordFailure("example.com:443")
+	if !c.isBackingOff("example.com:443") {
+		t.Fatal("expected a backoff window to be active right after a recorded failure")
+	}
+	if c.isBackingOff("other.example:443") {
+		t.Fatal("expected the backoff to be scoped to the authority that failed")
+	}
+}
+
+func TestAltSvcCacheObserve(t *testing.T) {
+	c := newAltSvcCache()
+
+	c.observe("example.com:443", "")
+	if c.supportsH3("example.com:443") {
+		t.Fatal("expected an empty header to be a no-op")
+	}
+
+	c.observe("example.com:443", "clear")
+	if c.supportsH3("example.com:443") {
+		t.Fatal("expected a header with no h3 entry to be a no-op")
+	}
+
+	c.observe("example.com:443", `h3=":443"; ma=3600`)
+	if !c.supportsH3("example.com:443") {
+		t.Fatal("expected observe to remember h3 support parsed from the header")
+	}
+}
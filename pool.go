@@ -0,0 +1,226 @@
+package uhc
+
+import (
+	"bufio"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// h3Conn pairs an HTTP/3 round tripper with the QUIC connection it was built
+// from, so the pool can tell a dead connection apart from a reusable one.
+type h3Conn struct {
+	rt   *http3.SingleDestinationRoundTripper
+	conn quic.Connection
+}
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 2
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// idleConn is a free HTTP/1.1 uTLS connection sitting in the pool, waiting
+// to be reused or reaped by the idle timeout.
+type idleConn struct {
+	conn   *utls.UConn
+	reader *bufio.Reader
+	timer  *time.Timer
+}
+
+// connPool keeps h2 *http2.ClientConn and idle HTTP/1.1 uTLS connections
+// around so Transport.RoundTrip doesn't have to pay for a fresh TCP+uTLS
+// handshake on every request, mirroring what net/http.Transport does with
+// its own idleConn/http2 connection pool.
+type connPool struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	h2conns map[string][]*http2.ClientConn
+	h3conns map[string]*h3Conn
+	idle    map[string][]*idleConn
+	idleLen int
+}
+
+func newConnPool(maxIdleConns, maxIdleConnsPerHost int, idleConnTimeout time.Duration) *connPool {
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+	return &connPool{
+		maxIdleConns:        maxIdleConns,
+		maxIdleConnsPerHost: maxIdleConnsPerHost,
+		idleConnTimeout:     idleConnTimeout,
+		h2conns:             make(map[string][]*http2.ClientConn),
+		h3conns:             make(map[string]*h3Conn),
+		idle:                make(map[string][]*idleConn),
+	}
+}
+
+// connKey identifies connections that can be reused for one another: same
+// destination, same proxy chain and same TLS fingerprint.
+func connKey(address, helloID, proxyKey string) string {
+	return address + "|" + helloID + "|" + proxyKey
+}
+
+func (p *connPool) getH2(key string) *http2.ClientConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.h2conns[key]
+	for i := 0; i < len(conns); i++ {
+		cc := conns[i]
+		if cc.State().Closed || !cc.CanTakeNewRequest() {
+			conns = append(conns[:i], conns[i+1:]...)
+			i--
+			continue
+		}
+		p.h2conns[key] = conns
+		return cc
+	}
+	if len(conns) == 0 {
+		delete(p.h2conns, key)
+	} else {
+		p.h2conns[key] = conns
+	}
+	return nil
+}
+
+func (p *connPool) putH2(key string, cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		cc.Close()
+		return
+	}
+	p.h2conns[key] = append(p.h2conns[key], cc)
+}
+
+func (p *connPool) getH3(key string) *http3.SingleDestinationRoundTripper {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.h3conns[key]
+	if !ok {
+		return nil
+	}
+	if c.conn.Context().Err() != nil {
+		delete(p.h3conns, key)
+		return nil
+	}
+	return c.rt
+}
+
+func (p *connPool) putH3(key string, rt *http3.SingleDestinationRoundTripper, conn quic.Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.CloseWithError(0, "")
+		return
+	}
+	p.h3conns[key] = &h3Conn{rt: rt, conn: conn}
+}
+
+func (p *connPool) getIdle(key string) (*utls.UConn, *bufio.Reader) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := p.idle[key]
+	if len(list) == 0 {
+		return nil, nil
+	}
+	ic := list[len(list)-1]
+	p.idle[key] = list[:len(list)-1]
+	p.idleLen--
+	ic.timer.Stop()
+	return ic.conn, ic.reader
+}
+
+// putIdle returns a connection to the free list, unless the pool is closed
+// or already full, in which case the caller should close it instead.
+func (p *connPool) putIdle(key string, conn *utls.UConn, reader *bufio.Reader) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.idleLen >= p.maxIdleConns || len(p.idle[key]) >= p.maxIdleConnsPerHost {
+		return false
+	}
+
+	ic := &idleConn{conn: conn, reader: reader}
+	ic.timer = time.AfterFunc(p.idleConnTimeout, func() {
+		p.removeIdle(key, ic)
+	})
+	p.idle[key] = append(p.idle[key], ic)
+	p.idleLen++
+	return true
+}
+
+// removeIdle is the idle timer's callback. Because Timer.Stop returns false
+// once the timer has already fired, getIdle racing against an expiring entry
+// can pop it for reuse just before this runs; only close the connection if
+// it was actually still sitting in the idle list, or a request that just
+// received it from getIdle would have it closed out from under it.
+func (p *connPool) removeIdle(key string, target *idleConn) {
+	p.mu.Lock()
+	list := p.idle[key]
+	found := false
+	for i, ic := range list {
+		if ic == target {
+			p.idle[key] = append(list[:i], list[i+1:]...)
+			p.idleLen--
+			found = true
+			break
+		}
+	}
+	p.mu.Unlock()
+	if found {
+		target.conn.Close()
+	}
+}
+
+// closeIdleConnections closes and forgets every pooled connection.
+func (p *connPool) closeIdleConnections() {
+	p.mu.Lock()
+	idle := p.idle
+	h2conns := p.h2conns
+	h3conns := p.h3conns
+	p.idle = make(map[string][]*idleConn)
+	p.h2conns = make(map[string][]*http2.ClientConn)
+	p.h3conns = make(map[string]*h3Conn)
+	p.idleLen = 0
+	p.mu.Unlock()
+
+	for _, list := range idle {
+		for _, ic := range list {
+			ic.timer.Stop()
+			ic.conn.Close()
+		}
+	}
+	for _, conns := range h2conns {
+		for _, cc := range conns {
+			cc.Close()
+		}
+	}
+	for _, c := range h3conns {
+		c.conn.CloseWithError(0, "")
+	}
+}
+
+func (p *connPool) close() {
+	p.closeIdleConnections()
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+}
@@ -0,0 +1,166 @@
+package uhc
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// newTestUConn wraps one end of an in-memory pipe in a *utls.UConn, without
+// ever handshaking it, so pool bookkeeping can be exercised without a real
+// TLS peer. The caller is responsible for closing both ends.
+func newTestUConn(t *testing.T) (*utls.UConn, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	uc := utls.UClient(client, &utls.Config{InsecureSkipVerify: true}, utls.HelloChrome_Auto)
+	return uc, server
+}
+
+func TestConnPoolIdleReuse(t *testing.T) {
+	p := newConnPool(0, 0, 0)
+	uc, server := newTestUConn(t)
+	defer server.Close()
+	defer uc.Close()
+
+	key := connKey("example.com:443", "chrome", "")
+	reader := bufio.NewReader(uc)
+	if !p.putIdle(key, uc, reader) {
+		t.Fatal("expected putIdle to accept the connection")
+	}
+
+	gotConn, gotReader := p.getIdle(key)
+	if gotConn != uc || gotReader != reader {
+		t.Fatal("expected getIdle to return the connection just put in, for reuse")
+	}
+
+	if conn, _ := p.getIdle(key); conn != nil {
+		t.Fatal("expected the pool to be empty after getIdle drained its one entry")
+	}
+}
+
+func TestConnPoolMaxIdleConnsPerHost(t *testing.T) {
+	p := newConnPool(10, 1, time.Minute)
+	key := connKey("example.com:443", "chrome", "")
+
+	uc1, server1 := newTestUConn(t)
+	defer server1.Close()
+	defer uc1.Close()
+	uc2, server2 := newTestUConn(t)
+	defer server2.Close()
+	defer uc2.Close()
+
+	if !p.putIdle(key, uc1, bufio.NewReader(uc1)) {
+		t.Fatal("expected the first idle connection to be accepted")
+	}
+	if p.putIdle(key, uc2, bufio.NewReader(uc2)) {
+		t.Fatal("expected a second idle connection to be rejected by MaxIdleConnsPerHost")
+	}
+}
+
+func TestConnPoolIdleTimeout(t *testing.T) {
+	p := newConnPool(10, 10, 20*time.Millisecond)
+	uc, server := newTestUConn(t)
+	defer server.Close()
+
+	key := connKey("example.com:443", "chrome", "")
+	if !p.putIdle(key, uc, bufio.NewReader(uc)) {
+		t.Fatal("expected putIdle to accept the connection")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if conn, _ := p.getIdle(key); conn != nil {
+		t.Fatal("expected the idle connection to have been evicted by its idle timeout")
+	}
+}
+
+// TestConnPoolRemoveIdleAfterReuse guards against a race where the idle
+// timer's callback fires concurrently with a getIdle that already reused the
+// same connection: Timer.Stop can't stop a callback that already started,
+// so removeIdle must check the connection is still actually idle before
+// closing it, or it closes a connection a request just received for reuse.
+func TestConnPoolRemoveIdleAfterReuse(t *testing.T) {
+	p := newConnPool(10, 10, time.Minute)
+	uc, server := newTestUConn(t)
+	defer server.Close()
+	defer uc.Close()
+
+	key := connKey("example.com:443", "chrome", "")
+	if !p.putIdle(key, uc, bufio.NewReader(uc)) {
+		t.Fatal("expected putIdle to accept the connection")
+	}
+
+	p.mu.Lock()
+	ic := p.idle[key][0]
+	p.mu.Unlock()
+
+	conn, _ := p.getIdle(key)
+	if conn != uc {
+		t.Fatal("expected getIdle to return the connection just put in")
+	}
+
+	// Simulate the idle timer's callback running after getIdle already
+	// reused the connection (Timer.Stop can't prevent an already-started
+	// callback from running).
+	p.removeIdle(key, ic)
+
+	uc.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := uc.Write([]byte("x"))
+	if err == nil {
+		t.Fatal("expected the write to block (nothing is reading) rather than succeed")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected a write timeout proving the reused connection is still open, got: %v", err)
+	}
+}
+
+func TestConnPoolH2Reuse(t *testing.T) {
+	p := newConnPool(0, 0, 0)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	cc, err := (&http2.Transport{}).NewClientConn(client)
+	if err != nil {
+		t.Fatalf("new http2 client conn failed: %v", err)
+	}
+
+	key := connKey("example.com:443", "chrome", "")
+	p.putH2(key, cc)
+
+	if got := p.getH2(key); got != cc {
+		t.Fatal("expected getH2 to return the connection just put in, for reuse")
+	}
+
+	// getH2 doesn't remove live h2 connections the way getIdle does for
+	// HTTP/1.1, since h2 multiplexes many requests over one connection.
+	if got := p.getH2(key); got != cc {
+		t.Fatal("expected a live h2 connection to still be handed out on a later call")
+	}
+}
+
+func TestConnPoolCloseIdleConnections(t *testing.T) {
+	p := newConnPool(10, 10, time.Minute)
+	uc, server := newTestUConn(t)
+	defer server.Close()
+
+	key := connKey("example.com:443", "chrome", "")
+	p.putIdle(key, uc, bufio.NewReader(uc))
+
+	p.closeIdleConnections()
+
+	if conn, _ := p.getIdle(key); conn != nil {
+		t.Fatal("expected closeIdleConnections to have emptied the idle pool")
+	}
+	// The underlying conn should have been closed too; writing to it now
+	// should fail.
+	if _, err := uc.Write([]byte("x")); err == nil {
+		t.Fatal("expected the evicted connection to be closed")
+	}
+}
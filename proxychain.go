@@ -0,0 +1,158 @@
+package uhc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// resolveProxyChain decides which proxy hop(s), if any, req should be routed
+// through. ProxyChain takes precedence over Proxy, matching the precedence
+// http.Transport gives a caller-set Proxy func over nothing being set.
+func (t *Transport) resolveProxyChain(req *http.Request) ([]*url.URL, error) {
+	if len(t.ProxyChain) > 0 {
+		return t.ProxyChain, nil
+	}
+	if t.Proxy == nil {
+		return nil, nil
+	}
+	u, err := t.Proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, nil
+	}
+	return []*url.URL{u}, nil
+}
+
+// proxyChainKey renders hops into a string suitable for use as (part of) a
+// connPool key, so connections dialed through different proxy chains are
+// never pooled together.
+func proxyChainKey(hops []*url.URL) string {
+	if len(hops) == 0 {
+		return ""
+	}
+	parts := make([]string, len(hops))
+	for i, hop := range hops {
+		parts[i] = hop.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// dialProxyChain dials hops[0] directly, then tunnels hop by hop (via SOCKS5
+// CONNECT or HTTP CONNECT, per hop scheme) until address is reached, handing
+// back a net.Conn ready for the uTLS handshake with the final target.
+func dialProxyChain(ctx context.Context, network, address string, hops []*url.URL) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, hostPort(hops[0]))
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s failed: %w", hops[0].Host, err)
+	}
+
+	for i, hop := range hops {
+		if hop.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: hop.Hostname()})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("tls handshake with proxy %s failed: %w", hop.Host, err)
+			}
+			conn = tlsConn
+		}
+
+		next := address
+		if i+1 < len(hops) {
+			next = hostPort(hops[i+1])
+		}
+
+		switch hop.Scheme {
+		case "socks5", "socks5h":
+			if err := socks5Connect(conn, next, hop.User); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("socks5 connect to %s via %s failed: %w", next, hop.Host, err)
+			}
+		case "http", "https":
+			tunneled, err := httpConnect(conn, next, hop)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("http connect to %s via %s failed: %w", next, hop.Host, err)
+			}
+			conn = tunneled
+		default:
+			conn.Close()
+			return nil, fmt.Errorf("unsupported proxy scheme: %s", hop.Scheme)
+		}
+	}
+
+	return conn, nil
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// httpConnect tunnels to address through an HTTP/HTTPS proxy using CONNECT,
+// the same mechanism net/http and most corporate proxies use for HTTPS. It
+// returns the conn to use for everything after the tunnel is established,
+// which may not be conn itself: see bufferedConn.
+func httpConnect(conn net.Conn, address string, proxyURL *url.URL) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		req.Header.Set("Proxy-Authorization", "Basic "+basicAuth(proxyURL.User))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("write CONNECT request failed: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT response failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected CONNECT response status: %s", resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// bufio.Reader's fill can pull in bytes past the CONNECT response
+		// headers in the same Read; those belong to the tunneled traffic
+		// (e.g. the next hop's TLS ServerHello) and must be replayed rather
+		// than dropped.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn replays bytes already pulled into r but not yet consumed,
+// before resuming reads from the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func basicAuth(user *url.Userinfo) string {
+	password, _ := user.Password()
+	return base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+}
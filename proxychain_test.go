@@ -0,0 +1,233 @@
+package uhc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHttpConnectSuccess(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := http.ReadRequest(bufio.NewReader(server)); err != nil {
+			t.Errorf("server: read CONNECT request failed: %v", err)
+			return
+		}
+		server.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	}()
+
+	proxyURL := &url.URL{Scheme: "http", Host: "proxy.example:8080"}
+	conn, err := httpConnect(client, "target.example:443", proxyURL)
+	<-done
+	if err != nil {
+		t.Fatalf("httpConnect failed: %v", err)
+	}
+	if conn != client {
+		t.Fatal("expected httpConnect to hand back the original conn when nothing was buffered past the headers")
+	}
+}
+
+func TestHttpConnectBufferedBytesReplayed(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := http.ReadRequest(bufio.NewReader(server)); err != nil {
+			t.Errorf("server: read CONNECT request failed: %v", err)
+			return
+		}
+		// Written in one Write so it lands in the client's bufio.Reader fill
+		// alongside the response headers, exercising the replay path.
+		server.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\nREPLAYED"))
+	}()
+
+	proxyURL := &url.URL{Scheme: "http", Host: "proxy.example:8080"}
+	conn, err := httpConnect(client, "target.example:443", proxyURL)
+	<-done
+	if err != nil {
+		t.Fatalf("httpConnect failed: %v", err)
+	}
+	if _, ok := conn.(*bufferedConn); !ok {
+		t.Fatal("expected httpConnect to wrap conn in a bufferedConn when bytes were buffered past the headers")
+	}
+
+	got := make([]byte, len("REPLAYED"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read replayed bytes failed: %v", err)
+	}
+	if string(got) != "REPLAYED" {
+		t.Fatalf("expected replayed bytes %q, got %q", "REPLAYED", got)
+	}
+}
+
+func TestHttpConnectSendsProxyAuthorization(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var gotAuth string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			t.Errorf("server: read CONNECT request failed: %v", err)
+			return
+		}
+		gotAuth = req.Header.Get("Proxy-Authorization")
+		server.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	}()
+
+	proxyURL := &url.URL{Scheme: "http", Host: "proxy.example:8080", User: url.UserPassword("alice", "s3cret")}
+	if _, err := httpConnect(client, "target.example:443", proxyURL); err != nil {
+		t.Fatalf("httpConnect failed: %v", err)
+	}
+	<-done
+
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret"))
+	if gotAuth != want {
+		t.Fatalf("expected Proxy-Authorization %q, got %q", want, gotAuth)
+	}
+}
+
+func TestHttpConnectNon200Status(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := http.ReadRequest(bufio.NewReader(server)); err != nil {
+			t.Errorf("server: read CONNECT request failed: %v", err)
+			return
+		}
+		server.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+	}()
+
+	proxyURL := &url.URL{Scheme: "http", Host: "proxy.example:8080"}
+	_, err := httpConnect(client, "target.example:443", proxyURL)
+	<-done
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected an error mentioning the CONNECT failure status, got: %v", err)
+	}
+}
+
+func TestResolveProxyChainPrecedence(t *testing.T) {
+	chainHop := &url.URL{Scheme: "socks5", Host: "chain.example:1080"}
+	tr := &Transport{
+		ProxyChain: []*url.URL{chainHop},
+		Proxy: func(*http.Request) (*url.URL, error) {
+			t.Fatal("Proxy should not be consulted when ProxyChain is set")
+			return nil, nil
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	hops, err := tr.resolveProxyChain(req)
+	if err != nil {
+		t.Fatalf("resolveProxyChain failed: %v", err)
+	}
+	if len(hops) != 1 || hops[0] != chainHop {
+		t.Fatalf("expected ProxyChain to take precedence, got %v", hops)
+	}
+}
+
+func TestResolveProxyChainFallsBackToProxy(t *testing.T) {
+	proxyURL := &url.URL{Scheme: "http", Host: "proxy.example:8080"}
+	tr := &Transport{
+		Proxy: func(*http.Request) (*url.URL, error) { return proxyURL, nil },
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	hops, err := tr.resolveProxyChain(req)
+	if err != nil {
+		t.Fatalf("resolveProxyChain failed: %v", err)
+	}
+	if len(hops) != 1 || hops[0] != proxyURL {
+		t.Fatalf("expected the Proxy func's URL as the single hop, got %v", hops)
+	}
+}
+
+func TestResolveProxyChainNone(t *testing.T) {
+	tr := &Transport{}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	hops, err := tr.resolveProxyChain(req)
+	if err != nil || hops != nil {
+		t.Fatalf("expected no hops and no error, got %v, %v", hops, err)
+	}
+}
+
+func TestProxyChainKey(t *testing.T) {
+	if got := proxyChainKey(nil); got != "" {
+		t.Fatalf("expected an empty key for no hops, got %q", got)
+	}
+
+	hops := []*url.URL{
+		{Scheme: "socks5", Host: "a.example:1080"},
+		{Scheme: "http", Host: "b.example:8080"},
+	}
+	want := "socks5://a.example:1080,http://b.example:8080"
+	if got := proxyChainKey(hops); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+// TestDialProxyChainTwoHops exercises a two-hop chain (SOCKS5 then HTTP
+// CONNECT) entirely over the single connection dialProxyChain opens to the
+// first hop, the same way a real chain is tunneled hop by hop.
+func TestDialProxyChainTwoHops(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("accept failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// Hop 1: SOCKS5 CONNECT to hop 2.
+		fakeSocks5Server(t, conn, socks5AuthNone, false, socks5Succeeded)
+
+		// Hop 2: HTTP CONNECT to the final target, tunneled over the same conn.
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			t.Errorf("server: read CONNECT request failed: %v", err)
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	}()
+
+	hops := []*url.URL{
+		{Scheme: "socks5", Host: ln.Addr().String()},
+		{Scheme: "http", Host: "second-hop.example:8080"},
+	}
+
+	conn, err := dialProxyChain(context.Background(), "tcp", "final.example:443", hops)
+	<-done
+	if err != nil {
+		t.Fatalf("dialProxyChain failed: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,32 @@
+package uhc
+
+// WithServerName overrides the hostname presented in the TLS ServerName
+// (SNI) extension, independent of the request's own Host. The original Host
+// header is still sent as-is, which is what domain-fronting workflows rely
+// on: dial/verify against one name, tell the server you want another.
+func WithServerName(serverName string) TransportOption {
+	return func(t *Transport) {
+		t.ServerName = serverName
+	}
+}
+
+// WithRemoveSNI strips the SNI extension from the ClientHello entirely,
+// overriding WithServerName. Not all servers accept a handshake without SNI,
+// so this is mainly useful against endpoints that are known to allow it.
+func WithRemoveSNI(remove bool) TransportOption {
+	return func(t *Transport) {
+		t.RemoveSNI = remove
+	}
+}
+
+// WithECHConfigList sets an ECH (Encrypted Client Hello) configuration list,
+// as published in a server's HTTPS/SVCB DNS record, to use for the
+// handshake. Whether this actually encrypts the ClientHello depends on the
+// selected ClientHelloID presenting a real (non-GREASE) ECH extension;
+// today uTLS only ships a GREASE placeholder, so this mainly wires the
+// config through for when that lands upstream.
+func WithECHConfigList(configList []byte) TransportOption {
+	return func(t *Transport) {
+		t.ECHConfigList = configList
+	}
+}
@@ -0,0 +1,194 @@
+package uhc_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/refraction-networking/utls/dicttls"
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/zijiren233/go-uhc"
+)
+
+// captureSNI stands up a local crypto/tls server, points a Transport built
+// from opts at it, and returns the ServerName crypto/tls itself parsed out
+// of the ClientHello. GetConfigForClient aborts the handshake right after
+// capturing it (there's no certificate to complete one with), so RoundTrip
+// is always expected to return an error.
+func captureSNI(t *testing.T, opts ...uhc.TransportOption) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	serverNames := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		srv := tls.Server(conn, &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				serverNames <- hello.ServerName
+				return nil, errors.New("uhc test: aborting handshake after capturing ClientHello")
+			},
+		})
+		srv.SetDeadline(time.Now().Add(5 * time.Second))
+		srv.Handshake()
+	}()
+
+	opts = append(opts, uhc.WithTimeout(5*time.Second))
+	tr := uhc.NewTransport(opts...)
+	req, err := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatalf("new request failed: %v", err)
+	}
+
+	resp, err := tr.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected handshake to fail, got a response")
+	}
+
+	select {
+	case sn := <-serverNames:
+		return sn
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ClientHello")
+		return ""
+	}
+}
+
+func TestWithServerName(t *testing.T) {
+	const front = "front.example.test"
+	sn := captureSNI(t, uhc.WithServerName(front))
+	if sn != front {
+		t.Fatalf("expected ClientHello SNI %q, got %q", front, sn)
+	}
+}
+
+func TestWithRemoveSNI(t *testing.T) {
+	const front = "front.example.test"
+	sn := captureSNI(t, uhc.WithServerName(front), uhc.WithRemoveSNI(true))
+	if sn != "" {
+		t.Fatalf("expected ClientHello to have no SNI, got %q", sn)
+	}
+}
+
+// roundTripErr points a Transport built from opts at a local listener that
+// accepts and immediately closes the connection, and returns the resulting
+// RoundTrip error. It's used to check what happens before the handshake
+// proper (e.g. ECH config list parsing), not the handshake itself.
+func roundTripErr(t *testing.T, opts ...uhc.TransportOption) error {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+
+	opts = append(opts, uhc.WithTimeout(5*time.Second))
+	tr := uhc.NewTransport(opts...)
+	req, err := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatalf("new request failed: %v", err)
+	}
+
+	resp, err := tr.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected RoundTrip to fail")
+	}
+	return err
+}
+
+func TestWithECHConfigListInvalid(t *testing.T) {
+	err := roundTripErr(t, uhc.WithECHConfigList([]byte{0x00, 0x01, 0x02}))
+	if !strings.Contains(err.Error(), "parse ECH config list failed") {
+		t.Fatalf("expected an ECH config list parse error, got: %v", err)
+	}
+}
+
+func TestWithECHConfigList(t *testing.T) {
+	err := roundTripErr(t, uhc.WithECHConfigList(buildECHConfigList(t)))
+	if strings.Contains(err.Error(), "parse ECH config list failed") {
+		t.Fatalf("expected a well-formed ECH config list to parse, got: %v", err)
+	}
+}
+
+// buildECHConfigList builds a single, well-formed ECHConfigList (the format
+// utls.UnmarshalECHConfigs expects) around a freshly generated HPKE key
+// pair, so WithECHConfigList has something real to parse in tests.
+func buildECHConfigList(t *testing.T) []byte {
+	t.Helper()
+
+	scheme := hpke.KEM_X25519_HKDF_SHA256.Scheme()
+	pub, _, err := scheme.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("generate ECH key pair failed: %v", err)
+	}
+	pubBytes, err := pub.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal ECH public key failed: %v", err)
+	}
+
+	var contents cryptobyte.Builder
+	contents.AddUint8(1) // config_id
+	contents.AddUint16(uint16(hpke.KEM_X25519_HKDF_SHA256))
+	contents.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(pubBytes)
+	})
+	contents.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(dicttls.HKDF_SHA256)
+		b.AddUint16(dicttls.AEAD_AES_128_GCM)
+	})
+	contents.AddUint8(64) // maximum_name_length
+	contents.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("front.example.test"))
+	})
+	contents.AddUint16LengthPrefixed(func(*cryptobyte.Builder) {}) // extensions
+	contentsBytes, err := contents.Bytes()
+	if err != nil {
+		t.Fatalf("build ECH config contents failed: %v", err)
+	}
+
+	var config cryptobyte.Builder
+	config.AddUint16(0xfe0d) // draft-ietf-tls-esni-17 version
+	config.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(contentsBytes)
+	})
+	configBytes, err := config.Bytes()
+	if err != nil {
+		t.Fatalf("build ECH config failed: %v", err)
+	}
+
+	var list cryptobyte.Builder
+	list.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(configBytes)
+	})
+	listBytes, err := list.Bytes()
+	if err != nil {
+		t.Fatalf("build ECH config list failed: %v", err)
+	}
+	return listBytes
+}
@@ -0,0 +1,186 @@
+package uhc
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeSocks5Server reads a SOCKS5 greeting, replies with method, optionally
+// authenticates, then reads the CONNECT request and replies with reply. It
+// runs synchronously against one end of a net.Pipe, mirroring just enough of
+// RFC 1928/1929 to exercise socks5Connect's side of the handshake.
+func fakeSocks5Server(t *testing.T, conn net.Conn, method byte, authOK bool, reply byte) {
+	t.Helper()
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Errorf("server: read greeting failed: %v", err)
+		return
+	}
+	if greeting[0] != socks5Version {
+		t.Errorf("server: unexpected version %d", greeting[0])
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		t.Errorf("server: read methods failed: %v", err)
+		return
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		t.Errorf("server: write method selection failed: %v", err)
+		return
+	}
+	if method == socks5AuthNoAcceptable {
+		return
+	}
+
+	if method == socks5AuthUserPass {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Errorf("server: read auth header failed: %v", err)
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+			t.Errorf("server: read username failed: %v", err)
+			return
+		}
+		passLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, passLen); err != nil {
+			t.Errorf("server: read password length failed: %v", err)
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, passLen[0])); err != nil {
+			t.Errorf("server: read password failed: %v", err)
+			return
+		}
+		status := byte(0x00)
+		if !authOK {
+			status = 0x01
+		}
+		if _, err := conn.Write([]byte{0x01, status}); err != nil {
+			t.Errorf("server: write auth response failed: %v", err)
+			return
+		}
+		if !authOK {
+			return
+		}
+	}
+
+	reqHeader := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reqHeader); err != nil {
+		t.Errorf("server: read CONNECT header failed: %v", err)
+		return
+	}
+	if reqHeader[0] != socks5Version || reqHeader[1] != socks5CmdConnect || reqHeader[3] != socks5AddrDomain {
+		t.Errorf("server: unexpected CONNECT request header: % x", reqHeader)
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, int(reqHeader[4])+2)); err != nil {
+		t.Errorf("server: read CONNECT domain/port failed: %v", err)
+		return
+	}
+
+	header := []byte{socks5Version, reply, 0x00, socks5AddrDomain}
+	if reply != socks5Succeeded {
+		// socks5Connect returns as soon as it sees a non-success reply code,
+		// without reading the bound address that would normally follow; only
+		// write what it actually consumes, or the write blocks forever.
+		conn.Write(header)
+		return
+	}
+	conn.Write(append(header, 0x00, 0x00, 0x00))
+}
+
+func TestSocks5ConnectNoAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeSocks5Server(t, server, socks5AuthNone, false, socks5Succeeded)
+	}()
+
+	if err := socks5Connect(client, "target.example:443", nil); err != nil {
+		t.Fatalf("socks5Connect failed: %v", err)
+	}
+	<-done
+}
+
+func TestSocks5ConnectWithAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeSocks5Server(t, server, socks5AuthUserPass, true, socks5Succeeded)
+	}()
+
+	auth := url.UserPassword("alice", "s3cret")
+	if err := socks5Connect(client, "target.example:443", auth); err != nil {
+		t.Fatalf("socks5Connect failed: %v", err)
+	}
+	<-done
+}
+
+func TestSocks5ConnectAuthFailure(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeSocks5Server(t, server, socks5AuthUserPass, false, socks5Succeeded)
+	}()
+
+	auth := url.UserPassword("alice", "wrong")
+	err := socks5Connect(client, "target.example:443", auth)
+	<-done
+	if err == nil {
+		t.Fatal("expected socks5Connect to fail when authentication is rejected")
+	}
+}
+
+func TestSocks5ConnectNoAcceptableMethods(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeSocks5Server(t, server, socks5AuthNoAcceptable, false, socks5Succeeded)
+	}()
+
+	err := socks5Connect(client, "target.example:443", nil)
+	<-done
+	if err == nil || !strings.Contains(err.Error(), "rejected all authentication methods") {
+		t.Fatalf("expected a rejected-methods error, got: %v", err)
+	}
+}
+
+func TestSocks5ConnectFailureCode(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeSocks5Server(t, server, socks5AuthNone, false, 0x05) // connection refused
+	}()
+
+	err := socks5Connect(client, "target.example:443", nil)
+	<-done
+	if err == nil || !strings.Contains(err.Error(), "CONNECT failed with code 5") {
+		t.Fatalf("expected a CONNECT failure error, got: %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	utls "github.com/refraction-networking/utls"
@@ -43,12 +44,81 @@ func WithClientHelloID(clientHelloID utls.ClientHelloID) TransportOption {
 	}
 }
 
+// WithClientHelloIDFunc sets a function that picks the ClientHelloID to use
+// for each request, overriding ClientHelloID. Use it to fingerprint per-host
+// or per-request instead of presenting the same ClientHelloID to everyone;
+// NewClientHelloIDRotator builds a ready-made rotating ClientHelloIDFunc.
+func WithClientHelloIDFunc(fn ClientHelloIDFunc) TransportOption {
+	return func(t *Transport) {
+		t.ClientHelloIDFunc = fn
+	}
+}
+
+// WithClientHelloSpec sets a fully custom utls.ClientHelloSpec to present on
+// the handshake, overriding both ClientHelloID and ClientHelloIDFunc. Use
+// this when a preset ClientHelloID isn't enough, e.g. custom extension
+// ordering or ALPN.
+func WithClientHelloSpec(spec *utls.ClientHelloSpec) TransportOption {
+	return func(t *Transport) {
+		t.ClientHelloSpec = spec
+	}
+}
+
 func WithInsecureSkipVerify(insecureSkipVerify bool) TransportOption {
 	return func(t *Transport) {
 		t.InsecureSkipVerify = insecureSkipVerify
 	}
 }
 
+// WithMaxIdleConns sets the maximum number of idle HTTP/1.1 uTLS
+// connections kept across all hosts, mirroring http.Transport.MaxIdleConns.
+// A value <= 0 uses the default of 100.
+func WithMaxIdleConns(n int) TransportOption {
+	return func(t *Transport) {
+		t.MaxIdleConns = n
+	}
+}
+
+// WithMaxIdleConnsPerHost sets the maximum number of idle HTTP/1.1 uTLS
+// connections kept per host, mirroring http.Transport.MaxIdleConnsPerHost.
+// A value <= 0 uses the default of 2.
+func WithMaxIdleConnsPerHost(n int) TransportOption {
+	return func(t *Transport) {
+		t.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithIdleConnTimeout sets how long an idle HTTP/1.1 uTLS connection is kept
+// in the pool before it is closed, mirroring http.Transport.IdleConnTimeout.
+// A value <= 0 uses the default of 90s.
+func WithIdleConnTimeout(d time.Duration) TransportOption {
+	return func(t *Transport) {
+		t.IdleConnTimeout = d
+	}
+}
+
+// WithProxy sets the function used to choose a proxy for a given request,
+// matching the signature of http.Transport.Proxy. http.ProxyFromEnvironment
+// or http.ProxyURL can be used directly. A nil *url.URL (with a nil error)
+// means no proxy.
+func WithProxy(proxy ProxyFunc) TransportOption {
+	return func(t *Transport) {
+		t.Proxy = proxy
+	}
+}
+
+// WithProxyChain sets an ordered list of upstream proxies to hop through
+// before reaching the destination. Each hop's URL scheme selects how it is
+// negotiated: "socks5"/"socks5h" issues a SOCKS5 CONNECT, "http"/"https"
+// issues an HTTP CONNECT (establishing TLS to the hop first for "https").
+// Credentials are read from the hop URL's userinfo. WithProxyChain takes
+// precedence over WithProxy when both are set.
+func WithProxyChain(proxies ...*url.URL) TransportOption {
+	return func(t *Transport) {
+		t.ProxyChain = proxies
+	}
+}
+
 func NewTransport(opts ...TransportOption) *Transport {
 	t := &Transport{}
 	for _, opt := range opts {
@@ -57,29 +127,92 @@ func NewTransport(opts ...TransportOption) *Transport {
 	return t
 }
 
+// ProxyFunc selects the proxy to use for a request, matching the signature
+// of http.Transport.Proxy.
+type ProxyFunc func(*http.Request) (*url.URL, error)
+
 type Transport struct {
-	ClientHelloID      utls.ClientHelloID
-	httpTransport      *http.Transport
-	h2Transport        *http2.Transport
-	ProxySocks5        *url.URL
-	Timeout            time.Duration
-	InsecureSkipVerify bool
+	ClientHelloID       utls.ClientHelloID
+	ClientHelloIDFunc   ClientHelloIDFunc
+	ClientHelloSpec     *utls.ClientHelloSpec
+	httpTransport       *http.Transport
+	h2Transport         *http2.Transport
+	Proxy               ProxyFunc
+	ProxyChain          []*url.URL
+	Timeout             time.Duration
+	InsecureSkipVerify  bool
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	ForceHTTP3          bool
+	ServerName          string
+	RemoveSNI           bool
+	ECHConfigList       []byte
+	DisableCompression  bool
+
+	poolOnce sync.Once
+	pool     *connPool
+
+	altSvcOnce sync.Once
+	altSvc     *altSvcCache
+}
+
+// connPool lazily builds (or returns) the pool of reusable h2/h1 connections
+// for this Transport, so a zero-value Transport keeps working without
+// requiring callers to go through NewTransport.
+func (t *Transport) connPool() *connPool {
+	t.poolOnce.Do(func() {
+		t.pool = newConnPool(t.MaxIdleConns, t.MaxIdleConnsPerHost, t.IdleConnTimeout)
+	})
+	return t.pool
+}
+
+// CloseIdleConnections closes any connections sitting idle in the pool,
+// like http.Transport.CloseIdleConnections. Pooled HTTP/2 and HTTP/3
+// connections are closed as well, whether or not they are idle, so requests
+// still in flight on them are interrupted.
+func (t *Transport) CloseIdleConnections() {
+	t.connPool().closeIdleConnections()
 }
 
+func (t *Transport) altSvcState() *altSvcCache {
+	t.altSvcOnce.Do(func() {
+		t.altSvc = newAltSvcCache()
+	})
+	return t.altSvc
+}
+
+// utlsHttpBody wraps the raw response body read off a pooled HTTP/1.1 uTLS
+// connection. On Close it either hands the connection back to the pool for
+// reuse, or closes it outright when it can no longer be reused (the body
+// wasn't fully drained, or the server asked to close the connection).
 type utlsHttpBody struct {
-	conn    *utls.UConn
-	rawBody io.ReadCloser
+	conn      *utls.UConn
+	reader    *bufio.Reader
+	rawBody   io.ReadCloser
+	pool      *connPool
+	poolKey   string
+	keepAlive bool
+	eof       bool
 }
 
 var _ io.ReadCloser = (*utlsHttpBody)(nil)
 
 func (u *utlsHttpBody) Read(p []byte) (int, error) {
-	return u.rawBody.Read(p)
+	n, err := u.rawBody.Read(p)
+	if err == io.EOF {
+		u.eof = true
+	}
+	return n, err
 }
 
 func (u *utlsHttpBody) Close() error {
-	defer u.conn.Close()
-	return u.rawBody.Close()
+	err := u.rawBody.Close()
+	if u.keepAlive && u.eof && u.pool != nil && u.pool.putIdle(u.poolKey, u.conn, u.reader) {
+		return err
+	}
+	u.conn.Close()
+	return err
 }
 
 const maxHeaderListSize = 262144
@@ -109,34 +242,204 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		defer cancel()
 	}
 
-	clientHelloID := t.ClientHelloID
-	if clientHelloID.IsSet() {
-		clientHelloID = defaultClientHelloID
-	}
+	setAE := t.maybeSetAcceptEncoding(req)
+
+	clientHelloID, helloSpec, helloKey := t.selectClientHello(req)
 
 	address := net.JoinHostPort(req.URL.Hostname(), getRequestPort(req))
-	conn, err := t.dialContext(ctx, "tcp", address)
+	hops, err := t.resolveProxyChain(req)
+	if err != nil {
+		return nil, fmt.Errorf("resolve proxy failed: %w", err)
+	}
+
+	pool := t.connPool()
+	key := connKey(address, helloKey, proxyChainKey(hops)) + "|" + t.sniKey()
+
+	// HTTP/3 only makes sense end-to-end over UDP, so it's skipped whenever
+	// the request is routed through a TCP proxy chain. It's also skipped
+	// when RemoveSNI or ECHConfigList are set: crypto/tls (which the QUIC
+	// stack uses, unlike the uTLS-driven TCP path) has no way to strip the
+	// SNI extension or to present a non-GREASE ECH, so honoring either would
+	// require silently dropping the protection instead.
+	if len(hops) == 0 && !t.RemoveSNI && len(t.ECHConfigList) == 0 {
+		altSvc := t.altSvcState()
+		if (t.ForceHTTP3 || altSvc.supportsH3(address)) && !altSvc.isBackingOff(address) {
+			// req.Body may already be partially consumed by the H3 attempt
+			// by the time it fails, so only try H3 first when we can rewind
+			// it (or there's nothing to rewind) before falling through to
+			// the h2/h1 path below.
+			if req.Body == nil || req.GetBody != nil {
+				resp, err := t.roundTripH3(ctx, req, pool, key, clientHelloID, address)
+				if err == nil {
+					return t.decodeResponse(resp, setAE), nil
+				}
+				altSvc.recordFailure(address)
+				if req.GetBody != nil {
+					body, err := req.GetBody()
+					if err != nil {
+						return nil, fmt.Errorf("rewind request body after http/3 failure: %w", err)
+					}
+					req.Body = body
+				}
+			}
+		}
+	}
+
+	if cc := pool.getH2(key); cc != nil {
+		req.Proto = "HTTP/2.0"
+		req.ProtoMajor = 2
+		req.ProtoMinor = 0
+
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			return nil, fmt.Errorf("do http/2 request failed: %w", err)
+		}
+		t.altSvcState().observe(address, resp.Header.Get("Alt-Svc"))
+		return t.decodeResponse(resp, setAE), nil
+	}
+
+	if conn, reader := pool.getIdle(key); conn != nil {
+		resp, err := t.doHttp1(req, conn, reader, pool, key)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		t.altSvcState().observe(address, resp.Header.Get("Alt-Svc"))
+		return t.decodeResponse(resp, setAE), nil
+	}
+
+	conn, err := t.dialContext(ctx, "tcp", address, hops)
 	if err != nil {
 		return nil, fmt.Errorf("dial %s failed: %w", address, err)
 	}
 
+	serverName := req.URL.Hostname()
+	if t.ServerName != "" {
+		serverName = t.ServerName
+	}
 	config := &utls.Config{
-		ServerName:         req.URL.Hostname(),
+		ServerName:         serverName,
 		InsecureSkipVerify: t.InsecureSkipVerify,
 	}
+	if len(t.ECHConfigList) > 0 {
+		echConfigs, err := utls.UnmarshalECHConfigs(t.ECHConfigList)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("parse ECH config list failed: %w", err)
+		}
+		config.ECHConfigs = echConfigs
+	}
+
 	uTlsConn := utls.UClient(conn, config, clientHelloID)
+	if helloSpec != nil {
+		if err := uTlsConn.ApplyPreset(helloSpec); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("apply client hello spec failed: %w", err)
+		}
+	}
+	if t.RemoveSNI {
+		if err := uTlsConn.RemoveSNIExtension(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("remove SNI extension failed: %w", err)
+		}
+	}
 	if err := uTlsConn.HandshakeContext(ctx); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("utls handshake failed: %w", err)
 	}
 
-	resp, err := doHttpOverConn(t.h2Transport, req, uTlsConn, uTlsConn.ConnectionState().NegotiatedProtocol)
-	if err != nil {
+	switch alpn := uTlsConn.ConnectionState().NegotiatedProtocol; alpn {
+	case "h2":
+		req.Proto = "HTTP/2.0"
+		req.ProtoMajor = 2
+		req.ProtoMinor = 0
+
+		cc, err := getH2RoundTripper(t.h2Transport, uTlsConn)
+		if err != nil {
+			uTlsConn.Close()
+			return nil, fmt.Errorf("get http/2 round tripper failed: %w", err)
+		}
+		pool.putH2(key, cc)
+
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			return nil, fmt.Errorf("do http/2 request failed: %w", err)
+		}
+		t.altSvcState().observe(address, resp.Header.Get("Alt-Svc"))
+		return t.decodeResponse(resp, setAE), nil
+
+	case "http/1.1", "":
+		resp, err := t.doHttp1(req, uTlsConn, bufio.NewReader(uTlsConn), pool, key)
+		if err != nil {
+			uTlsConn.Close()
+			return nil, err
+		}
+		t.altSvcState().observe(address, resp.Header.Get("Alt-Svc"))
+		return t.decodeResponse(resp, setAE), nil
+
+	default:
 		uTlsConn.Close()
-		return nil, fmt.Errorf("do http over conn failed: %w", err)
+		return nil, fmt.Errorf("unsupported ALPN: %v", alpn)
+	}
+}
+
+// sniKey folds the SNI-affecting options into the connection pool key, so a
+// connection handshaked with a spoofed/removed SNI is never handed back for
+// a request that expects the normal one.
+func (t *Transport) sniKey() string {
+	if t.RemoveSNI {
+		return "nosni"
+	}
+	return t.ServerName
+}
+
+// selectClientHello decides what to present on the handshake: a custom spec
+// takes priority over a per-request ClientHelloIDFunc, which in turn takes
+// priority over the static ClientHelloID. It also returns the string used to
+// key the connection pool, so requests presenting different fingerprints
+// never share a connection.
+func (t *Transport) selectClientHello(req *http.Request) (utls.ClientHelloID, *utls.ClientHelloSpec, string) {
+	if t.ClientHelloSpec != nil {
+		return utls.HelloCustom, t.ClientHelloSpec, fmt.Sprintf("spec-%p", t.ClientHelloSpec)
+	}
+
+	if t.ClientHelloIDFunc != nil {
+		id := t.ClientHelloIDFunc(req)
+		return id, nil, id.Str()
+	}
+
+	id := t.ClientHelloID
+	if id.IsSet() {
+		id = defaultClientHelloID
+	}
+	return id, nil, id.Str()
+}
+
+// doHttp1 writes req over conn as HTTP/1.1 and, on success, wraps the
+// response body so the connection is returned to the pool (rather than
+// closed) once the caller fully drains it and the server allows keep-alive.
+func (t *Transport) doHttp1(req *http.Request, conn *utls.UConn, reader *bufio.Reader, pool *connPool, key string) (*http.Response, error) {
+	req.Proto = "HTTP/1.1"
+	req.ProtoMajor = 1
+	req.ProtoMinor = 1
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("write http/1.1 request failed: %w", err)
+	}
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("read http/1.1 response failed: %w", err)
 	}
 
-	resp.Body = &utlsHttpBody{conn: uTlsConn, rawBody: resp.Body}
+	resp.Body = &utlsHttpBody{
+		conn:      conn,
+		reader:    reader,
+		rawBody:   resp.Body,
+		pool:      pool,
+		poolKey:   key,
+		keepAlive: !resp.Close,
+	}
 	return resp, nil
 }
 
@@ -150,20 +453,11 @@ func getRequestPort(req *http.Request) string {
 	return "80"
 }
 
-func (t *Transport) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	if t.ProxySocks5 == nil {
+func (t *Transport) dialContext(ctx context.Context, network, address string, hops []*url.URL) (net.Conn, error) {
+	if len(hops) == 0 {
 		return proxy.Dial(ctx, network, address)
 	}
-
-	dialer, err := proxy.FromURL(t.ProxySocks5, proxy.Direct)
-	if err != nil {
-		return nil, err
-	}
-
-	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
-		return contextDialer.DialContext(ctx, network, address)
-	}
-	return dialer.Dial(network, address)
+	return dialProxyChain(ctx, network, address, hops)
 }
 
 func getHttpRoundTripper(rt *http.Transport) http.RoundTripper {
@@ -174,7 +468,7 @@ func getHttpRoundTripper(rt *http.Transport) http.RoundTripper {
 	return rt
 }
 
-func getH2RoundTripper(rt *http2.Transport, conn net.Conn) (http.RoundTripper, error) {
+func getH2RoundTripper(rt *http2.Transport, conn net.Conn) (*http2.ClientConn, error) {
 	if rt == nil {
 		return defaultH2Transport.NewClientConn(conn)
 	}
@@ -182,36 +476,3 @@ func getH2RoundTripper(rt *http2.Transport, conn net.Conn) (http.RoundTripper, e
 	rt.MaxHeaderListSize = maxHeaderListSize
 	return rt.NewClientConn(conn)
 }
-
-func doHttpOverConn(rt *http2.Transport, req *http.Request, conn net.Conn, alpn string) (*http.Response, error) {
-	switch alpn {
-	case "h2":
-		req.Proto = "HTTP/2.0"
-		req.ProtoMajor = 2
-		req.ProtoMinor = 0
-
-		rt, err := getH2RoundTripper(rt, conn)
-		if err != nil {
-			return nil, fmt.Errorf("get http/2 round tripper failed: %w", err)
-		}
-
-		resp, err := rt.RoundTrip(req)
-		if err != nil {
-			return nil, fmt.Errorf("do http/2 request failed: %w", err)
-		}
-		return resp, nil
-
-	case "http/1.1", "":
-		req.Proto = "HTTP/1.1"
-		req.ProtoMajor = 1
-		req.ProtoMinor = 1
-
-		if err := req.Write(conn); err != nil {
-			return nil, fmt.Errorf("write http/1.1 request failed: %w", err)
-		}
-		return http.ReadResponse(bufio.NewReader(conn), req)
-
-	default:
-		return nil, fmt.Errorf("unsupported ALPN: %v", alpn)
-	}
-}